@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// bootstrapScripts lists the repo-root scripts applyCmd will run, in order, after
+// symlinks are in place. Only the first one found is executed.
+var bootstrapScripts = []string{"install.sh", "bootstrap.sh", "setup.sh"}
+
+// applyCmd materializes the tracked dotfiles onto a fresh machine: it ensures the
+// configured repo is present locally, symlinks every tracked entry from $HOME to
+// the repo copy, and finally runs a bootstrap script if the repo ships one.
+func applyCmd(cfg *Config, configPath string, force bool) error {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	repoDir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	dotfilesRepoDir := filepath.Join(repoDir, "dotfiles")
+
+	if err := ensureRepoCloned(repoDir, dotfilesRepoDir, configPath, cfg.Repo); err != nil {
+		return fmt.Errorf("preparing dotfiles repo: %w", err)
+	}
+
+	identityFile := resolveAgeIdentityFile(cfg)
+	for _, entry := range cfg.Dotfiles {
+		if !entry.Matches() {
+			fmt.Printf("Skipping %s: does not match this platform/host.\n", entry.Source)
+			continue
+		}
+		if entry.Encrypt {
+			if err := decryptEntry(entry, homeDir, dotfilesRepoDir, identityFile, force); err != nil {
+				log.Printf("Error applying %s: %v", entry.Source, err)
+			}
+			continue
+		}
+		if err := materializeSymlink(entry, homeDir, dotfilesRepoDir, force); err != nil {
+			log.Printf("Error applying %s: %v", entry.Source, err)
+		}
+	}
+
+	return runBootstrapScript(repoDir)
+}
+
+// ensureRepoCloned makes sure repoDir (the same directory init/sync commit
+// to, with tracked copies nested under dotfilesRepoDir) holds the configured
+// dotfiles repo, cloning it via remote if repoDir isn't a git checkout yet or
+// pulling the latest changes if it already is. On a fresh machine, repoDir
+// holds nothing but the bootstrap configPath the user placed there to point
+// at remote; go-git's clone checkout wipes any existing content in repoDir,
+// so that file is backed up one directory up (outside the clone target)
+// first rather than silently discarded. A pull failure (offline, unreachable
+// remote) is logged and not treated as fatal: the local checkout is already
+// present, so apply's symlink pass can proceed against it.
+func ensureRepoCloned(repoDir, dotfilesRepoDir, configPath, remote string) error {
+	if _, err := os.Stat(filepath.Join(repoDir, ".git")); os.IsNotExist(err) {
+		if remote == "" {
+			return os.MkdirAll(dotfilesRepoDir, 0755)
+		}
+		backupPath := filepath.Join(filepath.Dir(repoDir), filepath.Base(configPath)+".gotfiles-bak")
+		if err := os.Rename(configPath, backupPath); err == nil {
+			fmt.Printf("Moved local %s to %s before cloning.\n", filepath.Base(configPath), backupPath)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		fmt.Printf("Cloning %s into %s...\n", remote, repoDir)
+		_, err := cloneGitRepo(remote, repoDir)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	fmt.Println("Pulling latest dotfiles...")
+	repo, err := openGitRepo(repoDir)
+	if err != nil {
+		return err
+	}
+	if err := repo.Pull(); err != nil {
+		log.Printf("Pulling latest dotfiles failed, continuing with local copy: %v", err)
+	}
+	return nil
+}
+
+// materializeSymlink creates a symlink from $HOME/entry.Source to its repo
+// copy at entry.TargetPath(). If a conflicting file already exists at the
+// home location, it is moved into a timestamped backup directory inside the
+// repo (with --force) or the user is prompted interactively before it is
+// overwritten.
+func materializeSymlink(entry DotfileEntry, homeDir, dotfilesRepoDir string, force bool) error {
+	sourcePath := filepath.Join(homeDir, entry.Source)
+	destPath := filepath.Join(dotfilesRepoDir, entry.TargetPath())
+
+	if _, err := os.Stat(destPath); os.IsNotExist(err) {
+		return fmt.Errorf("no tracked copy of %s found in repository", entry.Source)
+	} else if err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(sourcePath)
+	if err == nil {
+		if fi.Mode()&os.ModeSymlink != 0 {
+			existing, err := os.Readlink(sourcePath)
+			if err == nil && existing == destPath {
+				fmt.Printf("%s is already linked.\n", entry.Source)
+				return nil
+			}
+		}
+		if err := backupConflict(entry.Source, sourcePath, dotfilesRepoDir, force); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(sourcePath), 0755); err != nil {
+		return err
+	}
+	if err := os.Symlink(destPath, sourcePath); err != nil {
+		return err
+	}
+	fmt.Printf("Created symlink for %s.\n", entry.Source)
+	runPostLink(entry, homeDir)
+	return nil
+}
+
+// decryptEntry decrypts entry's age-encrypted repo copy back into $HOME with
+// 0600 permissions. Unlike materializeSymlink, a pre-existing conflicting
+// file is never relocated into dotfilesRepoDir: the conflict here is a live
+// plaintext secret, and backupConflict's destination sits inside the
+// committed tree, where the next sync/init would stage and push it. Instead
+// the conflict is confirmed (or skipped, with --force) and the existing file
+// is moved aside in place with backupOriginal, the same way processPathWith
+// backs up originals before linking.
+func decryptEntry(entry DotfileEntry, homeDir, dotfilesRepoDir, identityFile string, force bool) error {
+	sourcePath := filepath.Join(homeDir, entry.Source)
+	destPath := filepath.Join(dotfilesRepoDir, entry.TargetPath())
+
+	if _, err := os.Stat(ageEncryptedPath(destPath)); os.IsNotExist(err) {
+		return fmt.Errorf("no encrypted copy of %s found in repository", entry.Source)
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(sourcePath); err == nil {
+		if !force && !confirm(fmt.Sprintf("%s already exists, overwrite it with the decrypted copy?", entry.Source)) {
+			return fmt.Errorf("skipped: %s already exists", entry.Source)
+		}
+		if _, err := backupOriginal(sourcePath); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := decryptFileFromRepo(sourcePath, destPath, identityFile); err != nil {
+		return err
+	}
+	fmt.Printf("Decrypted %s from repository.\n", entry.Source)
+	return nil
+}
+
+// backupConflict moves a pre-existing file or directory out of the way of a
+// symlink we are about to create, either unconditionally (force) or after
+// interactive confirmation.
+func backupConflict(item, sourcePath, dotfilesRepoDir string, force bool) error {
+	if !force && !confirm(fmt.Sprintf("%s already exists, move it aside and overwrite?", item)) {
+		return fmt.Errorf("skipped: %s already exists", item)
+	}
+
+	backupDir := filepath.Join(dotfilesRepoDir, "backup", time.Now().Format("20060102-150405"))
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(backupDir, item)), 0755); err != nil {
+		return err
+	}
+	backupPath := filepath.Join(backupDir, item)
+	if err := os.Rename(sourcePath, backupPath); err != nil {
+		return err
+	}
+	fmt.Printf("Moved existing %s to %s.\n", item, backupPath)
+	return nil
+}
+
+// confirm prompts the user with a yes/no question on stdin.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N]: ", question)
+	reader := bufio.NewReader(os.Stdin)
+	answer, err := reader.ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = answer[:len(answer)-1]
+	return answer == "y" || answer == "Y"
+}
+
+// runBootstrapScript runs the first install/bootstrap/setup script found at the
+// repo root, if any, so post-symlink setup steps carry over to the new machine.
+func runBootstrapScript(repoDir string) error {
+	for _, name := range bootstrapScripts {
+		scriptPath := filepath.Join(repoDir, name)
+		if _, err := os.Stat(scriptPath); err != nil {
+			continue
+		}
+		fmt.Printf("Running %s...\n", name)
+		cmd := exec.Command("/bin/sh", scriptPath)
+		cmd.Dir = repoDir
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Stdin = os.Stdin
+		return cmd.Run()
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// DotfileEntry describes one tracked dotfile or config directory. It may be
+// written as a bare path string in JSON/YAML/TOML configs, in which case Source is
+// populated and every other field keeps its zero value.
+type DotfileEntry struct {
+	// Source is the path relative to $HOME.
+	Source string `json:"source" yaml:"source" toml:"source"`
+	// Target is the path relative to dotfilesRepoDir. Defaults to Source,
+	// which lets e.g. ~/.config/nvim map to nvim/ in the repo.
+	Target string `json:"target" yaml:"target" toml:"target"`
+	// OS restricts the entry to the given GOOS values (linux/darwin/windows).
+	// Empty means every platform.
+	OS []string `json:"os" yaml:"os" toml:"os"`
+	// Hostname is a glob matched against the local hostname. Empty means
+	// every host.
+	Hostname string `json:"hostname" yaml:"hostname" toml:"hostname"`
+	// PostLink is a shell command run (from $HOME) after the symlink for
+	// this entry is created.
+	PostLink string `json:"post_link" yaml:"post_link" toml:"post_link"`
+	// Encrypt marks an entry as sensitive: init/sync store it in the repo
+	// age-encrypted (as TargetPath().age) instead of in cleartext, and it is
+	// never symlinked back, only ever decrypted by apply.
+	Encrypt bool `json:"encrypt" yaml:"encrypt" toml:"encrypt"`
+}
+
+// TargetPath returns the path relative to dotfilesRepoDir this entry is
+// stored under.
+func (e DotfileEntry) TargetPath() string {
+	if e.Target == "" {
+		return e.Source
+	}
+	return e.Target
+}
+
+// Matches reports whether this entry applies to the current machine,
+// according to its OS and Hostname predicates.
+func (e DotfileEntry) Matches() bool {
+	if len(e.OS) > 0 {
+		matched := false
+		for _, goos := range e.OS {
+			if goos == runtime.GOOS {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if e.Hostname != "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return false
+		}
+		ok, err := filepath.Match(e.Hostname, hostname)
+		if err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// UnmarshalJSON allows a dotfiles entry to be written as a bare path string
+// or as a full object with source/target/os/hostname/post_link.
+func (e *DotfileEntry) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		e.Source = path
+		return nil
+	}
+	type alias DotfileEntry
+	return json.Unmarshal(data, (*alias)(e))
+}
+
+// UnmarshalYAML allows a dotfiles entry to be written as a bare path string
+// or as a full mapping with source/target/os/hostname/post_link.
+func (e *DotfileEntry) UnmarshalYAML(value *yaml.Node) error {
+	var path string
+	if err := value.Decode(&path); err == nil {
+		e.Source = path
+		return nil
+	}
+	type alias DotfileEntry
+	return value.Decode((*alias)(e))
+}
+
+// UnmarshalTOML allows a dotfiles entry to be written as a bare path string
+// or as a full table with source/target/os/hostname/post_link. Unlike
+// UnmarshalJSON/UnmarshalYAML, TOML hands UnmarshalTOML the already-decoded
+// value (a string or a map[string]any) rather than raw bytes, so the table
+// case is routed back through JSON to reuse the same alias-decode trick.
+func (e *DotfileEntry) UnmarshalTOML(data any) error {
+	if path, ok := data.(string); ok {
+		e.Source = path
+		return nil
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	type alias DotfileEntry
+	return json.Unmarshal(raw, (*alias)(e))
+}
+
+// Config holds the list of dotfiles and config folders to track.
+type Config struct {
+	Dotfiles []DotfileEntry `json:"dotfiles" yaml:"dotfiles" toml:"dotfiles"`
+	Repo     string         `json:"repo" yaml:"repo" toml:"repo"`
+	// AgeRecipients are the age public keys entries with encrypt: true are
+	// encrypted to.
+	AgeRecipients []string `json:"age_recipients" yaml:"age_recipients" toml:"age_recipients"`
+	// AgeIdentityFile is the private key file apply decrypts encrypted
+	// entries with. Falls back to GOTFILES_AGE_IDENTITY if unset.
+	AgeIdentityFile string `json:"age_identity_file" yaml:"age_identity_file" toml:"age_identity_file"`
+}
+
+// loadConfig reads the dotfiles config, picking JSON, YAML or TOML decoding
+// based on configPath's extension.
+func loadConfig(configPath string) (*Config, error) {
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	switch ext := strings.ToLower(filepath.Ext(configPath)); ext {
+	case "", ".json":
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, err
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		if err := toml.Unmarshal(data, &cfg); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config format: %s", ext)
+	}
+	return &cfg, nil
+}
+
+// findConfigPath looks for a supported config file in repoDir, preferring
+// config.json for backwards compatibility.
+func findConfigPath(repoDir string) (string, error) {
+	for _, name := range []string{"config.json", "config.yaml", "config.yml", "config.toml"} {
+		candidate := filepath.Join(repoDir, name)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no config.json, config.yaml or config.toml found in %s", repoDir)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigBareStringsAndStructEntries(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	content := `{
+		"dotfiles": [
+			".bashrc",
+			{"source": ".config/nvim", "target": "nvim", "os": ["linux"], "post_link": "echo linked"}
+		],
+		"repo": "git@example.com:me/dotfiles.git"
+	}`
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Dotfiles) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(cfg.Dotfiles))
+	}
+	if cfg.Dotfiles[0].Source != ".bashrc" || cfg.Dotfiles[0].TargetPath() != ".bashrc" {
+		t.Fatalf("bare string entry not parsed correctly: %+v", cfg.Dotfiles[0])
+	}
+	nvim := cfg.Dotfiles[1]
+	if nvim.Source != ".config/nvim" || nvim.TargetPath() != "nvim" || nvim.PostLink != "echo linked" {
+		t.Fatalf("struct entry not parsed correctly: %+v", nvim)
+	}
+	if cfg.Repo != "git@example.com:me/dotfiles.git" {
+		t.Fatalf("repo not parsed: %q", cfg.Repo)
+	}
+}
+
+func TestLoadConfigTOMLBareStrings(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.toml")
+	content := `
+repo = "git@example.com:me/dotfiles.git"
+dotfiles = [".bashrc", ".vimrc"]
+`
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Dotfiles) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(cfg.Dotfiles))
+	}
+	if cfg.Dotfiles[0].Source != ".bashrc" || cfg.Dotfiles[1].Source != ".vimrc" {
+		t.Fatalf("bare string entries not parsed correctly: %+v", cfg.Dotfiles)
+	}
+}
+
+func TestLoadConfigTOMLTableEntry(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.toml")
+	content := `
+repo = "git@example.com:me/dotfiles.git"
+
+[[dotfiles]]
+source = ".config/nvim"
+target = "nvim"
+os = ["linux"]
+post_link = "echo linked"
+`
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Dotfiles) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(cfg.Dotfiles))
+	}
+	nvim := cfg.Dotfiles[0]
+	if nvim.Source != ".config/nvim" || nvim.TargetPath() != "nvim" || nvim.PostLink != "echo linked" {
+		t.Fatalf("table entry not parsed correctly: %+v", nvim)
+	}
+}
+
+func TestDotfileEntryMatchesOS(t *testing.T) {
+	entry := DotfileEntry{Source: ".bashrc", OS: []string{"plan9"}}
+	if entry.Matches() {
+		t.Fatalf("entry scoped to plan9 should not match this platform")
+	}
+
+	entry.OS = nil
+	if !entry.Matches() {
+		t.Fatalf("entry with no OS restriction should match")
+	}
+}
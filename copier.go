@@ -0,0 +1,31 @@
+package main
+
+import (
+	cp "github.com/otiai10/copy"
+)
+
+// Copier abstracts the recursive copy used to back a file or directory up
+// into the dotfiles repository. It exists so processPath can be exercised in
+// unit tests with an in-memory stand-in instead of touching the filesystem.
+type Copier interface {
+	Copy(src, dst string) error
+}
+
+// osCopier is the default Copier, backed by github.com/otiai10/copy. Unlike
+// the hand-rolled copyFile/copyDir it preserves file modes, ownership and
+// symlinks found inside the source tree instead of following and duplicating
+// them, which matters for directories like ~/.config that commonly nest
+// symlinks.
+type osCopier struct{}
+
+// defaultCopier is the Copier used by processPath outside of tests.
+var defaultCopier Copier = osCopier{}
+
+func (osCopier) Copy(src, dst string) error {
+	return cp.Copy(src, dst, cp.Options{
+		OnSymlink: func(string) cp.SymlinkAction {
+			return cp.Shallow
+		},
+		PreserveOwner: true,
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeCopier is a minimal Copier for tests: it records calls and performs a
+// plain byte-for-byte copy, standing in for the real otiai10/copy-backed one.
+type fakeCopier struct {
+	calls [][2]string
+}
+
+func (f *fakeCopier) Copy(src, dst string) error {
+	f.calls = append(f.calls, [2]string{src, dst})
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0644)
+}
+
+func TestProcessPathWithUsesInjectedCopier(t *testing.T) {
+	home := t.TempDir()
+	repo := t.TempDir()
+
+	item := "dotrc"
+	if err := os.WriteFile(filepath.Join(home, item), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	copier := &fakeCopier{}
+	processPathWith(copier, DotfileEntry{Source: item}, home, repo, false, nil)
+
+	if len(copier.calls) != 1 {
+		t.Fatalf("expected 1 copy call, got %d", len(copier.calls))
+	}
+	wantSrc, wantDst := filepath.Join(home, item), filepath.Join(repo, item)+".gotfiles-tmp"
+	if copier.calls[0] != [2]string{wantSrc, wantDst} {
+		t.Fatalf("copy call = %v, want {%s %s}", copier.calls[0], wantSrc, wantDst)
+	}
+
+	if got, err := os.ReadFile(filepath.Join(repo, item)); err != nil || string(got) != "content" {
+		t.Fatalf("repo copy = %q, %v", got, err)
+	}
+	link, err := os.Readlink(filepath.Join(home, item))
+	if err != nil || link != filepath.Join(repo, item) {
+		t.Fatalf("expected %s to be a symlink to repo copy, got %q, %v", item, link, err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// GitRepo wraps a go-git repository, replacing the earlier `git` shell-outs
+// so init/sync/apply work without a `git` binary or SSH agent on PATH.
+type GitRepo struct {
+	path string
+	repo *git.Repository
+}
+
+// openGitRepo opens the repository rooted at path.
+func openGitRepo(path string) (*GitRepo, error) {
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening git repo at %s: %w", path, err)
+	}
+	return &GitRepo{path: path, repo: repo}, nil
+}
+
+// cloneGitRepo clones remote into path and returns the resulting repo.
+func cloneGitRepo(remote, path string) (*GitRepo, error) {
+	repo, err := git.PlainClone(path, false, &git.CloneOptions{URL: remote})
+	if err != nil {
+		return nil, fmt.Errorf("cloning %s: %w", remote, err)
+	}
+	return &GitRepo{path: path, repo: repo}, nil
+}
+
+// Pull fast-forwards the repo's working tree from its configured remote.
+func (g *GitRepo) Pull() error {
+	wt, err := g.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	err = wt.Pull(&git.PullOptions{})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
+}
+
+// Status reports the pending changes in the working tree, for use by
+// --dry-run to print a plan without writing anything.
+func (g *GitRepo) Status() (git.Status, error) {
+	wt, err := g.repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	return wt.Status()
+}
+
+// AddAll stages every change in the working tree.
+func (g *GitRepo) AddAll() error {
+	wt, err := g.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	_, err = wt.Add(".")
+	return err
+}
+
+// Commit creates a commit with the given message, using the author resolved
+// by resolveAuthor. It returns git.ErrEmptyCommit if there is nothing staged.
+func (g *GitRepo) Commit(message string) error {
+	wt, err := g.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	author, err := resolveAuthor(g.repo)
+	if err != nil {
+		return err
+	}
+	_, err = wt.Commit(message, &git.CommitOptions{Author: author})
+	return err
+}
+
+// Push pushes the current branch to its configured remote.
+func (g *GitRepo) Push() error {
+	err := g.repo.Push(&git.PushOptions{})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
+}
+
+// resolveAuthor determines the commit author, preferring GOTFILES_AUTHOR
+// ("Name <email>") over the repo's git config, then the user's global git
+// config.
+func resolveAuthor(repo *git.Repository) (*object.Signature, error) {
+	if raw := os.Getenv("GOTFILES_AUTHOR"); raw != "" {
+		name, email, err := splitAuthor(raw)
+		if err != nil {
+			return nil, err
+		}
+		return &object.Signature{Name: name, Email: email, When: time.Now()}, nil
+	}
+
+	if cfg, err := repo.Config(); err == nil && cfg.User.Name != "" {
+		return &object.Signature{Name: cfg.User.Name, Email: cfg.User.Email, When: time.Now()}, nil
+	}
+
+	if global, err := config.LoadConfig(config.GlobalScope); err == nil && global.User.Name != "" {
+		return &object.Signature{Name: global.User.Name, Email: global.User.Email, When: time.Now()}, nil
+	}
+
+	return nil, fmt.Errorf("no commit author configured: set GOTFILES_AUTHOR or git config user.name/user.email")
+}
+
+// splitAuthor parses "Name <email>" into its parts.
+func splitAuthor(raw string) (name, email string, err error) {
+	open := strings.Index(raw, "<")
+	close := strings.Index(raw, ">")
+	if open < 0 || close < open {
+		return "", "", fmt.Errorf("GOTFILES_AUTHOR must look like \"Name <email>\", got %q", raw)
+	}
+	name = strings.TrimSpace(raw[:open])
+	email = strings.TrimSpace(raw[open+1 : close])
+	return name, email, nil
+}
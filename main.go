@@ -1,220 +1,378 @@
 package main
 
 import (
-	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+
+	"github.com/go-git/go-git/v5"
 )
 
-// Config holds the list of dotfiles and config folders to track.
-type Config struct {
-	Dotfiles []string `json:"dotfiles"`
+// processPath handles backing up a dotfile entry and ensuring the symlink exists.
+func processPath(entry DotfileEntry, homeDir, dotfilesRepoDir string, isSync bool, ageRecipients []string) {
+	processPathWith(defaultCopier, entry, homeDir, dotfilesRepoDir, isSync, ageRecipients)
 }
 
-func loadConfig(configPath string) (*Config, error) {
-	data, err := ioutil.ReadFile(configPath)
-	if err != nil {
-		return nil, err
+// processPathWith is processPath with an injectable Copier, so callers (and
+// tests) can swap the filesystem-backed implementation for an in-memory one.
+//
+// The original is never deleted until its copy in the repo has been
+// verified: it is copied to a temp file beside destPath, fsynced and renamed
+// into place, hash-checked against the source, and only then is the original
+// moved aside (never removed outright) and replaced with a symlink.
+//
+// Entries with Encrypt set are handled separately: they are age-encrypted
+// into the repo but never symlinked back, since the plaintext secret must
+// keep working in place at $HOME. apply is what decrypts them elsewhere.
+func processPathWith(copier Copier, entry DotfileEntry, homeDir, dotfilesRepoDir string, isSync bool, ageRecipients []string) {
+	sourcePath := filepath.Join(homeDir, entry.Source)
+	destPath := filepath.Join(dotfilesRepoDir, entry.TargetPath())
+
+	if entry.Encrypt {
+		if err := encryptEntry(entry, sourcePath, destPath, dotfilesRepoDir, ageRecipients, isSync); err != nil {
+			log.Printf("Error encrypting %s: %v", entry.Source, err)
+		}
+		return
 	}
-	var cfg Config
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		return nil, err
+
+	fi, err := os.Lstat(sourcePath)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		log.Printf("%s does not exist in home.", entry.Source)
+	case err != nil:
+		log.Printf("Error accessing %s: %v", entry.Source, err)
+		return
+	case fi.Mode()&os.ModeSymlink != 0:
+		fmt.Printf("Skipping backup for %s as it is already a symlink.\n", entry.Source)
+	default:
+		if err := copyAndLink(copier, entry, sourcePath, destPath, homeDir, dotfilesRepoDir, isSync); err != nil {
+			log.Printf("Error applying %s: %v", entry.Source, err)
+		}
+		return
 	}
-	return &cfg, nil
-}
 
-// copyFile copies a single file from src to dst.
-func copyFile(src, dst string) error {
-	input, err := os.Open(src)
-	if err != nil {
-		return err
+	// Source is already a symlink or missing: just make sure it points at the
+	// repo copy.
+	if _, err := os.Lstat(sourcePath); os.IsNotExist(err) {
+		if _, err := os.Stat(destPath); err == nil {
+			if err := os.Symlink(destPath, sourcePath); err != nil {
+				log.Printf("Error creating symlink for %s: %v", entry.Source, err)
+			} else {
+				fmt.Printf("Created symlink for %s.\n", entry.Source)
+				runPostLink(entry, homeDir)
+			}
+		} else {
+			log.Printf("No backup for %s found in repository.", entry.Source)
+		}
 	}
-	defer input.Close()
+}
 
-	dstDir := filepath.Dir(dst)
-	if err := os.MkdirAll(dstDir, 0755); err != nil {
-		return err
+// copyAndLink backs entry's source up into the repo (skipping the copy if
+// its content hash is unchanged since the last run) and then links it back.
+func copyAndLink(copier Copier, entry DotfileEntry, sourcePath, destPath, homeDir, dotfilesRepoDir string, isSync bool) error {
+	idx, err := loadIndex(dotfilesRepoDir)
+	if err != nil {
+		return fmt.Errorf("loading file index: %w", err)
 	}
 
-	output, err := os.Create(dst)
+	srcHash, err := hashPath(sourcePath)
 	if err != nil {
-		return err
+		return fmt.Errorf("hashing %s: %w", entry.Source, err)
 	}
-	defer output.Close()
 
-	_, err = io.Copy(output, input)
-	return err
-}
+	if idx[entry.TargetPath()] == srcHash {
+		if _, err := os.Stat(destPath); err == nil {
+			fmt.Printf("%s is unchanged, skipping copy.\n", entry.Source)
+			return finalizeLink(entry, sourcePath, destPath, homeDir, dotfilesRepoDir)
+		}
+	}
 
-// copyDir recursively copies a directory tree, attempting to preserve permissions.
-func copyDir(src, dst string) error {
-	srcInfo, err := os.Stat(src)
+	destHash, err := atomicCopyToRepo(copier, sourcePath, destPath)
 	if err != nil {
-		return err
+		return fmt.Errorf("copying %s: %w", entry.Source, err)
+	}
+	idx[entry.TargetPath()] = destHash
+	if err := idx.save(dotfilesRepoDir); err != nil {
+		return fmt.Errorf("saving file index: %w", err)
 	}
 
-	if err := os.MkdirAll(dst, srcInfo.Mode()); err != nil {
-		return err
+	if isSync {
+		fmt.Printf("Updated %s in repository.\n", entry.Source)
+	} else {
+		fmt.Printf("Copied %s to repository.\n", entry.Source)
 	}
+	return finalizeLink(entry, sourcePath, destPath, homeDir, dotfilesRepoDir)
+}
 
-	entries, err := ioutil.ReadDir(src)
+// finalizeLink moves the now-backed-up original aside and replaces it with a
+// symlink to the repo copy, only discarding the original (into .trash, not
+// unlinked outright) once the symlink is confirmed in place.
+func finalizeLink(entry DotfileEntry, sourcePath, destPath, homeDir, dotfilesRepoDir string) error {
+	backupPath, err := backupOriginal(sourcePath)
 	if err != nil {
-		return err
+		return fmt.Errorf("backing up original: %w", err)
 	}
 
-	for _, entry := range entries {
-		srcPath := filepath.Join(src, entry.Name())
-		dstPath := filepath.Join(dst, entry.Name())
-
-		if entry.IsDir() {
-			if err := copyDir(srcPath, dstPath); err != nil {
-				return err
-			}
-		} else {
-			if err := copyFile(srcPath, dstPath); err != nil {
-				return err
-			}
+	if err := os.Symlink(destPath, sourcePath); err != nil {
+		if restoreErr := os.Rename(backupPath, sourcePath); restoreErr != nil {
+			log.Printf("Error restoring %s after failed symlink: %v", entry.Source, restoreErr)
 		}
+		return fmt.Errorf("creating symlink: %w", err)
+	}
+	fmt.Printf("Created symlink for %s.\n", entry.Source)
+	runPostLink(entry, homeDir)
+
+	if err := moveToTrash(dotfilesRepoDir, backupPath, entry.Source); err != nil {
+		log.Printf("Error moving backup of %s to trash: %v", entry.Source, err)
 	}
 	return nil
 }
 
-// processPath handles backing up a file or directory and ensuring the symlink exists.
-func processPath(item, homeDir, dotfilesRepoDir string, isSync bool) {
-	sourcePath := filepath.Join(homeDir, item)
-	destPath := filepath.Join(dotfilesRepoDir, item)
+// encryptEntry age-encrypts sourcePath into ageEncryptedPath(destPath),
+// skipping entries whose content hash hasn't changed since the last run. The
+// plaintext at sourcePath is left untouched: encrypted entries are only ever
+// restored by apply, never symlinked.
+func encryptEntry(entry DotfileEntry, sourcePath, destPath, dotfilesRepoDir string, ageRecipients []string, isSync bool) error {
+	fi, err := os.Stat(sourcePath)
+	if os.IsNotExist(err) {
+		log.Printf("%s does not exist in home.", entry.Source)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("encrypt is only supported for files, not directories")
+	}
 
-	fi, err := os.Lstat(sourcePath)
-	if err == nil {
-		if fi.Mode()&os.ModeSymlink != 0 {
-			fmt.Printf("Skipping backup for %s as it is already a symlink.\n", item)
-		} else if fi.IsDir() {
-			// Copy directory recursively.
-			if err := copyDir(sourcePath, destPath); err != nil {
-				log.Printf("Error copying directory %s: %v", item, err)
-			} else {
-				if isSync {
-					fmt.Printf("Updated directory %s in repository.\n", item)
-				} else {
-					fmt.Printf("Copied directory %s to repository.\n", item)
-				}
-			}
-			// Remove the original directory.
-			if err := os.RemoveAll(sourcePath); err != nil {
-				log.Printf("Error removing original directory %s: %v", item, err)
-			}
-		} else {
-			// Copy file.
-			if err := copyFile(sourcePath, destPath); err != nil {
-				log.Printf("Error copying file %s: %v", item, err)
-			} else {
-				if isSync {
-					fmt.Printf("Updated file %s in repository.\n", item)
-				} else {
-					fmt.Printf("Copied file %s to repository.\n", item)
-				}
-			}
-			// Remove the original file.
-			if err := os.Remove(sourcePath); err != nil {
-				log.Printf("Error removing original file %s: %v", item, err)
-			}
-		}
-	} else if !os.IsNotExist(err) {
-		log.Printf("Error accessing %s: %v", item, err)
-	} else {
-		log.Printf("%s does not exist in home.", item)
+	idx, err := loadIndex(dotfilesRepoDir)
+	if err != nil {
+		return fmt.Errorf("loading file index: %w", err)
+	}
+	srcHash, err := hashPath(sourcePath)
+	if err != nil {
+		return fmt.Errorf("hashing %s: %w", entry.Source, err)
 	}
 
-	// Create symlink if the source no longer exists.
-	if _, err := os.Lstat(sourcePath); os.IsNotExist(err) {
-		if _, err := os.Stat(destPath); err == nil {
-			if err := os.Symlink(destPath, sourcePath); err != nil {
-				log.Printf("Error creating symlink for %s: %v", item, err)
-			} else {
-				fmt.Printf("Created symlink for %s.\n", item)
-			}
-		} else {
-			log.Printf("No backup for %s found in repository.", item)
+	if idx[entry.TargetPath()] == srcHash {
+		if _, err := os.Stat(ageEncryptedPath(destPath)); err == nil {
+			fmt.Printf("%s is unchanged, skipping encryption.\n", entry.Source)
+			return nil
 		}
 	}
+
+	if err := encryptFileToRepo(sourcePath, destPath, ageRecipients); err != nil {
+		return err
+	}
+	idx[entry.TargetPath()] = srcHash
+	if err := idx.save(dotfilesRepoDir); err != nil {
+		return fmt.Errorf("saving file index: %w", err)
+	}
+
+	if isSync {
+		fmt.Printf("Updated encrypted %s in repository.\n", entry.Source)
+	} else {
+		fmt.Printf("Encrypted %s to repository.\n", entry.Source)
+	}
+	return nil
 }
 
-func runGitCommand(dir string, args ...string) error {
-	cmd := exec.Command("git", args...)
-	cmd.Dir = dir
+// runPostLink runs an entry's post_link command, if any, from homeDir.
+func runPostLink(entry DotfileEntry, homeDir string) {
+	if entry.PostLink == "" {
+		return
+	}
+	cmd := exec.Command("/bin/sh", "-c", entry.PostLink)
+	cmd.Dir = homeDir
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	if err := cmd.Run(); err != nil {
+		log.Printf("Error running post_link for %s: %v", entry.Source, err)
+	}
 }
 
-func initCmd(items []string) error {
+// gitOptions controls how init/sync interact with the dotfiles git repo.
+type gitOptions struct {
+	DryRun   bool
+	NoCommit bool
+	NoPush   bool
+	Message  string
+}
+
+// parseGitOptions parses the --dry-run/--no-commit/--no-push/--message flags
+// shared by the init and sync subcommands.
+func parseGitOptions(name string, args []string) (*gitOptions, error) {
+	opts := &gitOptions{}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "print the plan of copies/symlinks/commits without writing anything")
+	fs.BoolVar(&opts.NoCommit, "no-commit", false, "stage changes but skip creating a commit")
+	fs.BoolVar(&opts.NoPush, "no-push", false, "skip pushing to the remote")
+	fs.StringVar(&opts.Message, "message", "", "commit message to use instead of the default")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+func initCmd(entries []DotfileEntry, repoDir string, opts *gitOptions, ageRecipients []string) error {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		return err
 	}
-	repoDir, err := os.Getwd()
+	dotfilesRepoDir := filepath.Join(repoDir, "dotfiles")
+
+	if opts.DryRun {
+		for _, entry := range entries {
+			printEntryPlan(entry, homeDir, dotfilesRepoDir)
+		}
+		return printGitPlan(repoDir)
+	}
+
+	if err := os.MkdirAll(dotfilesRepoDir, 0755); err != nil {
+		return err
+	}
+	if err := purgeTrash(dotfilesRepoDir); err != nil {
+		log.Printf("Error purging expired trash: %v", err)
+	}
+	if err := ensureManagedGitignore(dotfilesRepoDir); err != nil {
+		log.Printf("Error writing managed .gitignore: %v", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.Matches() {
+			fmt.Printf("Skipping %s: does not match this platform/host.\n", entry.Source)
+			continue
+		}
+		processPath(entry, homeDir, dotfilesRepoDir, false, ageRecipients)
+	}
+
+	return commitAndPush(repoDir, opts, "Update dotfiles backup")
+}
+
+func syncCmd(entries []DotfileEntry, repoDir string, opts *gitOptions, ageRecipients []string) error {
+	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		return err
 	}
 	dotfilesRepoDir := filepath.Join(repoDir, "dotfiles")
-	if err := os.MkdirAll(dotfilesRepoDir, 0755); err != nil {
+	if _, err := os.Stat(dotfilesRepoDir); os.IsNotExist(err) {
+		return fmt.Errorf("dotfiles repository directory does not exist. Run 'gotfiles init' first")
+	}
+
+	if opts.DryRun {
+		for _, entry := range entries {
+			printEntryPlan(entry, homeDir, dotfilesRepoDir)
+		}
+		return printGitPlan(repoDir)
+	}
+
+	if err := purgeTrash(dotfilesRepoDir); err != nil {
+		log.Printf("Error purging expired trash: %v", err)
+	}
+	if err := ensureManagedGitignore(dotfilesRepoDir); err != nil {
+		log.Printf("Error writing managed .gitignore: %v", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.Matches() {
+			fmt.Printf("Skipping %s: does not match this platform/host.\n", entry.Source)
+			continue
+		}
+		processPath(entry, homeDir, dotfilesRepoDir, true, ageRecipients)
+	}
+
+	return commitAndPush(repoDir, opts, "Sync dotfiles changes")
+}
+
+// commitAndPush stages, commits and pushes the dotfiles repo according to
+// opts, logging (but not failing the command on) git errors, consistent with
+// the best-effort error handling the rest of init/sync uses. git.ErrEmptyCommit
+// is expected on an unchanged run and is not logged as an error.
+func commitAndPush(repoDir string, opts *gitOptions, defaultMessage string) error {
+	repo, err := openGitRepo(repoDir)
+	if err != nil {
 		return err
 	}
 
-	for _, item := range items {
-		processPath(item, homeDir, dotfilesRepoDir, false)
+	if err := repo.AddAll(); err != nil {
+		log.Printf("Error staging changes: %v", err)
 	}
 
-	if err := runGitCommand(repoDir, "add", "."); err != nil {
-		log.Printf("Error running git add: %v", err)
+	message := opts.Message
+	if message == "" {
+		message = defaultMessage
 	}
-	if err := runGitCommand(repoDir, "commit", "-m", "Update dotfiles backup"); err != nil {
-		log.Printf("Error running git commit: %v", err)
+
+	if !opts.NoCommit {
+		if err := repo.Commit(message); err != nil && err != git.ErrEmptyCommit {
+			log.Printf("Error committing changes: %v", err)
+		}
 	}
-	if err := runGitCommand(repoDir, "push"); err != nil {
-		log.Printf("Error running git push: %v", err)
+	if !opts.NoPush {
+		if err := repo.Push(); err != nil {
+			log.Printf("Error pushing changes: %v", err)
+		}
 	}
 	return nil
 }
 
-func syncCmd(items []string) error {
-	homeDir, err := os.UserHomeDir()
+// printGitPlan prints the pending changes in the dotfiles repo for --dry-run,
+// without staging, committing or pushing anything.
+func printGitPlan(repoDir string) error {
+	repo, err := openGitRepo(repoDir)
 	if err != nil {
 		return err
 	}
-	repoDir, err := os.Getwd()
+	status, err := repo.Status()
 	if err != nil {
 		return err
 	}
-	dotfilesRepoDir := filepath.Join(repoDir, "dotfiles")
-	if _, err := os.Stat(dotfilesRepoDir); os.IsNotExist(err) {
-		return fmt.Errorf("dotfiles repository directory does not exist. Run 'gotfiles init' first")
+	if status.IsClean() {
+		fmt.Println("Dry run: no changes to commit.")
+		return nil
 	}
+	fmt.Println("Dry run: would commit the following changes:")
+	fmt.Print(status.String())
+	return nil
+}
 
-	for _, item := range items {
-		processPath(item, homeDir, dotfilesRepoDir, true)
+// printEntryPlan describes, without performing it, what processPath would do
+// for entry.
+func printEntryPlan(entry DotfileEntry, homeDir, dotfilesRepoDir string) {
+	if !entry.Matches() {
+		fmt.Printf("Dry run: would skip %s (does not match this platform/host)\n", entry.Source)
+		return
 	}
+	sourcePath := filepath.Join(homeDir, entry.Source)
+	destPath := filepath.Join(dotfilesRepoDir, entry.TargetPath())
 
-	if err := runGitCommand(repoDir, "add", "."); err != nil {
-		log.Printf("Error running git add: %v", err)
-	}
-	if err := runGitCommand(repoDir, "commit", "-m", "Sync dotfiles changes"); err != nil {
-		log.Printf("Error running git commit: %v", err)
+	if entry.Encrypt {
+		fmt.Printf("Dry run: would encrypt %s to %s\n", sourcePath, ageEncryptedPath(destPath))
+		return
 	}
-	if err := runGitCommand(repoDir, "push"); err != nil {
-		log.Printf("Error running git push: %v", err)
+
+	fi, err := os.Lstat(sourcePath)
+	switch {
+	case err == nil && fi.Mode()&os.ModeSymlink != 0:
+		fmt.Printf("Dry run: would skip %s (already a symlink)\n", entry.Source)
+	case err == nil:
+		fmt.Printf("Dry run: would copy %s to %s and symlink it back\n", sourcePath, destPath)
+	case os.IsNotExist(err):
+		if _, err := os.Stat(destPath); err == nil {
+			fmt.Printf("Dry run: would symlink %s to %s\n", sourcePath, destPath)
+		} else {
+			fmt.Printf("Dry run: would skip %s (no source, no repo copy)\n", entry.Source)
+		}
+	default:
+		fmt.Printf("Dry run: error accessing %s: %v\n", entry.Source, err)
 	}
-	return nil
 }
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Usage: gotfiles <init|sync>")
+		fmt.Println("Usage: gotfiles <init|sync|apply> [--dry-run] [--no-commit] [--no-push] [--message msg]")
 		os.Exit(1)
 	}
 
@@ -222,7 +380,10 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	configPath := filepath.Join(repoDir, "config.json")
+	configPath, err := findConfigPath(repoDir)
+	if err != nil {
+		log.Fatal(err)
+	}
 	cfg, err := loadConfig(configPath)
 	if err != nil {
 		log.Fatalf("Error loading config file (%s): %v", configPath, err)
@@ -230,11 +391,29 @@ func main() {
 
 	switch os.Args[1] {
 	case "init":
-		if err := initCmd(cfg.Dotfiles); err != nil {
+		opts, err := parseGitOptions("init", os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := initCmd(cfg.Dotfiles, repoDir, opts, cfg.AgeRecipients); err != nil {
 			log.Fatal(err)
 		}
 	case "sync":
-		if err := syncCmd(cfg.Dotfiles); err != nil {
+		opts, err := parseGitOptions("sync", os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := syncCmd(cfg.Dotfiles, repoDir, opts, cfg.AgeRecipients); err != nil {
+			log.Fatal(err)
+		}
+	case "apply", "install":
+		force := false
+		for _, arg := range os.Args[2:] {
+			if arg == "--force" {
+				force = true
+			}
+		}
+		if err := applyCmd(cfg, configPath, force); err != nil {
 			log.Fatal(err)
 		}
 	default:
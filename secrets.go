@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// ageEncryptedPath returns the path an entry's age-encrypted ciphertext is
+// stored at in the repo: destPath with a ".age" suffix, so the committed
+// artifact for ~/.ssh/id_ed25519 is id_ed25519.age, never the plaintext key.
+func ageEncryptedPath(destPath string) string {
+	return destPath + ".age"
+}
+
+// encryptFileToRepo encrypts sourcePath to ageEncryptedPath(destPath) for the
+// given recipients, using the same temp-file-then-rename dance as
+// atomicCopyToRepo so a crash mid-write never leaves a half-written
+// ciphertext in place of a previous good one.
+func encryptFileToRepo(sourcePath, destPath string, recipients []string) error {
+	if len(recipients) == 0 {
+		return fmt.Errorf("no age_recipients configured for encrypted entry")
+	}
+	ageRecipients, err := age.ParseRecipients(strings.NewReader(strings.Join(recipients, "\n")))
+	if err != nil {
+		return fmt.Errorf("parsing age_recipients: %w", err)
+	}
+
+	encPath := ageEncryptedPath(destPath)
+	if err := os.MkdirAll(filepath.Dir(encPath), 0755); err != nil {
+		return err
+	}
+
+	tmpPath := encPath + ".gotfiles-tmp"
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return err
+	}
+	if err := encryptToFile(tmpPath, sourcePath, ageRecipients); err != nil {
+		os.RemoveAll(tmpPath)
+		return err
+	}
+	if err := fsyncPath(tmpPath); err != nil {
+		os.RemoveAll(tmpPath)
+		return err
+	}
+	if err := os.RemoveAll(encPath); err != nil {
+		os.RemoveAll(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, encPath)
+}
+
+func encryptToFile(tmpPath, sourcePath string, recipients []age.Recipient) error {
+	plaintext, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer plaintext.Close()
+
+	out, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w, err := age.Encrypt(out, recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, plaintext); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// decryptFileFromRepo decrypts ageEncryptedPath(destPath) using the identity
+// in identityFile, writing the plaintext to sourcePath with 0600 permissions.
+func decryptFileFromRepo(sourcePath, destPath, identityFile string) error {
+	if identityFile == "" {
+		return fmt.Errorf("no age identity file configured (set age_identity_file or GOTFILES_AGE_IDENTITY)")
+	}
+	identityData, err := ioutil.ReadFile(identityFile)
+	if err != nil {
+		return fmt.Errorf("reading age identity file: %w", err)
+	}
+	identities, err := age.ParseIdentities(strings.NewReader(string(identityData)))
+	if err != nil {
+		return fmt.Errorf("parsing age identity file: %w", err)
+	}
+
+	encFile, err := os.Open(ageEncryptedPath(destPath))
+	if err != nil {
+		return err
+	}
+	defer encFile.Close()
+
+	r, err := age.Decrypt(encFile, identities...)
+	if err != nil {
+		return fmt.Errorf("decrypting: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(sourcePath), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(sourcePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, r)
+	return err
+}
+
+// resolveAgeIdentityFile determines which private key file to decrypt with,
+// preferring the config's age_identity_file over GOTFILES_AGE_IDENTITY.
+func resolveAgeIdentityFile(cfg *Config) string {
+	path := cfg.AgeIdentityFile
+	if path == "" {
+		path = os.Getenv("GOTFILES_AGE_IDENTITY")
+	}
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, strings.TrimPrefix(path, "~"))
+		}
+	}
+	return path
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestEncryptEntryThenDecryptRoundTrips(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	home := t.TempDir()
+	repo := t.TempDir()
+	identityFile := filepath.Join(t.TempDir(), "key.age-identity")
+	if err := os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := DotfileEntry{Source: ".ssh/id_ed25519", Encrypt: true}
+	sourcePath := filepath.Join(home, entry.Source)
+	if err := os.MkdirAll(filepath.Dir(sourcePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(sourcePath, []byte("super secret key material"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	destPath := filepath.Join(repo, entry.TargetPath())
+	processPath(entry, home, repo, false, []string{identity.Recipient().String()})
+
+	if _, err := os.Stat(sourcePath); err != nil {
+		t.Fatalf("expected plaintext to remain at %s: %v", sourcePath, err)
+	}
+	encPath := ageEncryptedPath(destPath)
+	if _, err := os.Stat(encPath); err != nil {
+		t.Fatalf("expected encrypted copy at %s: %v", encPath, err)
+	}
+	if data, _ := os.ReadFile(encPath); string(data) == "super secret key material" {
+		t.Fatalf("encrypted copy must not contain plaintext")
+	}
+
+	// Apply on a fresh machine: decrypt into a clean home directory.
+	freshHome := t.TempDir()
+	if err := decryptEntry(entry, freshHome, repo, identityFile, false); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(freshHome, entry.Source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "super secret key material" {
+		t.Fatalf("decrypted content = %q, want original", got)
+	}
+}
+
+func TestDecryptEntryBacksUpConflictLocallyNotIntoRepo(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	home := t.TempDir()
+	repo := t.TempDir()
+	identityFile := filepath.Join(t.TempDir(), "key.age-identity")
+	if err := os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := DotfileEntry{Source: ".ssh/id_ed25519", Encrypt: true}
+	sourcePath := filepath.Join(home, entry.Source)
+	if err := os.MkdirAll(filepath.Dir(sourcePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(sourcePath, []byte("super secret key material"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	processPath(entry, home, repo, false, []string{identity.Recipient().String()})
+
+	// Simulate a re-apply: a conflicting plaintext already sits at $HOME.
+	if err := os.WriteFile(sourcePath, []byte("stale local copy"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := decryptEntry(entry, home, repo, identityFile, true); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(sourcePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "super secret key material" {
+		t.Fatalf("decrypted content = %q, want original", got)
+	}
+	if _, err := os.Stat(sourcePath + ".gotfiles-bak"); err != nil {
+		t.Fatalf("expected conflicting plaintext backed up locally at %s.gotfiles-bak: %v", sourcePath, err)
+	}
+	if _, err := os.Stat(filepath.Join(repo, "backup")); !os.IsNotExist(err) {
+		t.Fatalf("expected no backup directory inside the repo, got err=%v", err)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultTrashRetention is how long a backed-up original is kept in
+// dotfilesRepoDir/.trash before it is purged, unless overridden by
+// GOTFILES_TRASH_RETENTION_DAYS.
+const defaultTrashRetention = 7 * 24 * time.Hour
+
+// fileIndex maps a dotfile entry's repo-relative target path to the SHA-256
+// of the content last copied there, so sync can skip entries that haven't
+// changed instead of re-copying everything on every run.
+type fileIndex map[string]string
+
+func indexPath(dotfilesRepoDir string) string {
+	return filepath.Join(dotfilesRepoDir, ".gotfiles-index.json")
+}
+
+// loadIndex reads the persisted file index, returning an empty index if none
+// has been written yet.
+func loadIndex(dotfilesRepoDir string) (fileIndex, error) {
+	data, err := ioutil.ReadFile(indexPath(dotfilesRepoDir))
+	if os.IsNotExist(err) {
+		return fileIndex{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	idx := fileIndex{}
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// save persists the index back to dotfilesRepoDir.
+func (idx fileIndex) save(dotfilesRepoDir string) error {
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(indexPath(dotfilesRepoDir), data, 0644)
+}
+
+// hashPath returns the SHA-256 of a file's content, or of a directory's
+// content combined with each entry's relative path, walked in deterministic
+// (lexical) order. Symlinks are hashed by their target string rather than
+// followed, matching the cp.Shallow semantics osCopier copies them with, so
+// dangling links and links pointing outside the copied subtree (both common
+// under ~/.config) don't fail verification.
+func hashPath(path string) (string, error) {
+	h := sha256.New()
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if err := hashSymlinkInto(h, path); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	if !info.IsDir() {
+		if err := hashFileInto(h, path); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		io.WriteString(h, rel)
+		if info.Mode()&os.ModeSymlink != 0 {
+			return hashSymlinkInto(h, p)
+		}
+		return hashFileInto(h, p)
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFileInto(h io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// hashSymlinkInto hashes a symlink's target string instead of opening
+// through it, so a dangling link or one pointing outside the copied subtree
+// hashes identically on both sides of the copy instead of failing to open.
+func hashSymlinkInto(h io.Writer, path string) error {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(h, target)
+	return err
+}
+
+// atomicCopyToRepo copies sourcePath into destPath without ever truncating an
+// existing destPath in place: it copies to a temporary file beside destPath,
+// fsyncs it, and renames it into place, then verifies the copy by comparing
+// SHA-256 hashes of source and destination. On any failure destPath is left
+// untouched.
+func atomicCopyToRepo(copier Copier, sourcePath, destPath string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return "", err
+	}
+
+	tmpDest := destPath + ".gotfiles-tmp"
+	if err := os.RemoveAll(tmpDest); err != nil {
+		return "", err
+	}
+	if err := copier.Copy(sourcePath, tmpDest); err != nil {
+		os.RemoveAll(tmpDest)
+		return "", err
+	}
+	if err := fsyncPath(tmpDest); err != nil {
+		os.RemoveAll(tmpDest)
+		return "", err
+	}
+
+	if err := os.RemoveAll(destPath); err != nil {
+		os.RemoveAll(tmpDest)
+		return "", err
+	}
+	if err := os.Rename(tmpDest, destPath); err != nil {
+		return "", err
+	}
+
+	srcHash, err := hashPath(sourcePath)
+	if err != nil {
+		return "", err
+	}
+	destHash, err := hashPath(destPath)
+	if err != nil {
+		return "", err
+	}
+	if srcHash != destHash {
+		return "", fmt.Errorf("copy verification failed: source hash %s != dest hash %s", srcHash, destHash)
+	}
+	return destHash, nil
+}
+
+// fsyncPath fsyncs a file, or every regular file inside a directory tree, so
+// the copy is durable on disk before we touch the user's original.
+func fsyncPath(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fsyncFile(path)
+	}
+	return filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		return fsyncFile(p)
+	})
+}
+
+func fsyncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// backupOriginal renames sourcePath to sourcePath.gotfiles-bak, never
+// deleting it directly, so a process killed mid-apply leaves the user's data
+// recoverable.
+func backupOriginal(sourcePath string) (string, error) {
+	backupPath := sourcePath + ".gotfiles-bak"
+	if err := os.RemoveAll(backupPath); err != nil {
+		return "", err
+	}
+	if err := os.Rename(sourcePath, backupPath); err != nil {
+		return "", err
+	}
+	return backupPath, nil
+}
+
+// moveToTrash relocates a verified backup into dotfilesRepoDir/.trash under a
+// timestamped directory, where purgeTrash will reap it once the retention
+// window has passed, instead of unlinking it immediately.
+func moveToTrash(dotfilesRepoDir, backupPath, item string) error {
+	trashDir := filepath.Join(dotfilesRepoDir, ".trash", time.Now().Format("20060102-150405"))
+	trashItemPath := filepath.Join(trashDir, item)
+	if err := os.MkdirAll(filepath.Dir(trashItemPath), 0755); err != nil {
+		return err
+	}
+	return os.Rename(backupPath, trashItemPath)
+}
+
+// trashRetention resolves the trash retention window, overridable via
+// GOTFILES_TRASH_RETENTION_DAYS.
+func trashRetention() time.Duration {
+	raw := os.Getenv("GOTFILES_TRASH_RETENTION_DAYS")
+	if raw == "" {
+		return defaultTrashRetention
+	}
+	var days int
+	if _, err := fmt.Sscanf(raw, "%d", &days); err != nil || days <= 0 {
+		return defaultTrashRetention
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// purgeTrash removes timestamped trash directories older than the configured
+// retention window.
+func purgeTrash(dotfilesRepoDir string) error {
+	trashRoot := filepath.Join(dotfilesRepoDir, ".trash")
+	entries, err := ioutil.ReadDir(trashRoot)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	retention := trashRetention()
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		ts, err := time.ParseInLocation("20060102-150405", entry.Name(), time.Local)
+		if err != nil {
+			continue
+		}
+		if time.Since(ts) > retention {
+			if err := os.RemoveAll(filepath.Join(trashRoot, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// managedGitignoreEntries lists the paths gotfiles writes beside the tracked
+// copies that must never reach the remote: .trash and backup hold the user's
+// backed-up originals (from sync's finalizeLink and apply's backupConflict
+// respectively), and the index is local bookkeeping only.
+var managedGitignoreEntries = []string{".trash/", "backup/", ".gotfiles-index.json"}
+
+// ensureManagedGitignore makes sure dotfilesRepoDir/.gitignore excludes
+// managedGitignoreEntries, appending any that are missing and leaving the
+// rest of the file (including anything the user added by hand) untouched.
+// Without this, commitAndPush's plain `git add .` would stage backed-up
+// originals and the local file index onto the remote.
+func ensureManagedGitignore(dotfilesRepoDir string) error {
+	path := filepath.Join(dotfilesRepoDir, ".gitignore")
+	existing, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	present := map[string]bool{}
+	for _, line := range strings.Split(string(existing), "\n") {
+		present[line] = true
+	}
+
+	content := string(existing)
+	changed := false
+	for _, entry := range managedGitignoreEntries {
+		if present[entry] {
+			continue
+		}
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		content += entry + "\n"
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return ioutil.WriteFile(path, []byte(content), 0644)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProcessPathWithSkipsUnchangedContent(t *testing.T) {
+	home := t.TempDir()
+	repo := t.TempDir()
+	item := "dotrc"
+
+	write := func(path, content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(home, item), "content")
+
+	copier := &fakeCopier{}
+	processPathWith(copier, DotfileEntry{Source: item}, home, repo, false, nil)
+	if len(copier.calls) != 1 {
+		t.Fatalf("expected first run to copy once, got %d calls", len(copier.calls))
+	}
+
+	// Simulate recovering from a crash: the symlink is gone and a real file
+	// with the same content as the repo copy sits at the home location again.
+	if err := os.Remove(filepath.Join(home, item)); err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join(home, item), "content")
+	processPathWith(copier, DotfileEntry{Source: item}, home, repo, true, nil)
+
+	if len(copier.calls) != 1 {
+		t.Fatalf("expected unchanged content to skip the copy, got %d calls", len(copier.calls))
+	}
+}
+
+func TestHashPathDetectsChangedContent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f")
+	if err := os.WriteFile(path, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h1, err := hashPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h2, err := hashPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h1 == h2 {
+		t.Fatalf("expected different hashes for different content")
+	}
+}
+
+func TestEnsureManagedGitignoreAddsMissingEntries(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("custom-ignore\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ensureManagedGitignore(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(data)
+	for _, entry := range append([]string{"custom-ignore"}, managedGitignoreEntries...) {
+		if !strings.Contains(content, entry) {
+			t.Fatalf("expected .gitignore to contain %q, got %q", entry, content)
+		}
+	}
+
+	// Running again should be idempotent: no duplicate entries appended.
+	if err := ensureManagedGitignore(dir); err != nil {
+		t.Fatal(err)
+	}
+	data2, err := os.ReadFile(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data2) != content {
+		t.Fatalf("expected repeated calls to be idempotent, got %q then %q", content, string(data2))
+	}
+}
+
+func TestHashPathHandlesDanglingSymlink(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "dangling")
+	if err := os.Symlink(filepath.Join(dir, "does-not-exist"), link); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hashPath(link); err != nil {
+		t.Fatalf("expected dangling symlink to hash without error, got %v", err)
+	}
+
+	nested := filepath.Join(dir, "app")
+	if err := os.Mkdir(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "does-not-exist"), filepath.Join(nested, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hashPath(nested); err != nil {
+		t.Fatalf("expected directory with dangling symlink to hash without error, got %v", err)
+	}
+}